@@ -0,0 +1,37 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckpointSaveAndLoad(t *testing.T) {
+	cp := checkpoint{
+		Query:             "sars-cov-2 wastewater",
+		WebEnv:            "NCID_1_12345",
+		QueryKey:          "1",
+		TotalCount:        250,
+		CompletedRetStart: []int{0, 100},
+		OutputPath:        "out.tsv",
+	}
+
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	if err := cp.save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	got, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("loadCheckpoint: %v", err)
+	}
+	if !reflect.DeepEqual(got, cp) {
+		t.Errorf("loadCheckpoint() = %+v, want %+v", got, cp)
+	}
+}
+
+func TestLoadCheckpointMissingFile(t *testing.T) {
+	if _, err := loadCheckpoint(filepath.Join(t.TempDir(), "does-not-exist.json")); err == nil {
+		t.Error("loadCheckpoint() on a missing file = nil error, want an error")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseFieldSource(t *testing.T) {
+	cases := []struct {
+		name    string
+		spec    string
+		want    fieldSource
+		wantErr bool
+	}{
+		{name: "sample_attr", spec: "sample_attr:collection_date", want: fieldSource{Kind: "sample_attr", Name: "collection_date"}},
+		{name: "identifier", spec: "identifier:BioSample", want: fieldSource{Kind: "identifier", Name: "BioSample"}},
+		{name: "run_attr known", spec: "run_attr:total_bases", want: fieldSource{Kind: "run_attr", Name: "total_bases"}},
+		{name: "experiment known", spec: "experiment:bioproject", want: fieldSource{Kind: "experiment", Name: "bioproject"}},
+		{name: "run_attr unknown", spec: "run_attr:not_a_field", wantErr: true},
+		{name: "experiment unknown", spec: "experiment:not_a_field", wantErr: true},
+		{name: "unknown kind", spec: "bogus:name", wantErr: true},
+		{name: "missing colon", spec: "collection_date", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseFieldSource(tc.spec)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseFieldSource(%q) = nil error, want an error", tc.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFieldSource(%q): %v", tc.spec, err)
+			}
+			if got != tc.want {
+				t.Errorf("parseFieldSource(%q) = %+v, want %+v", tc.spec, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseFieldsFlagTagList(t *testing.T) {
+	got, err := parseFieldsFlag("collection_date, geo_loc_name,host")
+	if err != nil {
+		t.Fatalf("parseFieldsFlag: %v", err)
+	}
+	want := []field{
+		{Column: "collection_date", Source: fieldSource{Kind: "sample_attr", Name: "collection_date"}},
+		{Column: "geo_loc_name", Source: fieldSource{Kind: "sample_attr", Name: "geo_loc_name"}},
+		{Column: "host", Source: fieldSource{Kind: "sample_attr", Name: "host"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFieldsFlag() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseFieldsFlagEmpty(t *testing.T) {
+	if _, err := parseFieldsFlag(" , ,"); err == nil {
+		t.Error("parseFieldsFlag(\" , ,\") = nil error, want an error")
+	}
+}
+
+func TestParseFieldsFlagTemplateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fields.tsv")
+	contents := "# comment\n" +
+		"collection_date\tsample_attr:collection_date\n" +
+		"\n" +
+		"bioproject\texperiment:bioproject\n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	got, err := parseFieldsFlag(path)
+	if err != nil {
+		t.Fatalf("parseFieldsFlag: %v", err)
+	}
+	want := []field{
+		{Column: "collection_date", Source: fieldSource{Kind: "sample_attr", Name: "collection_date"}},
+		{Column: "bioproject", Source: fieldSource{Kind: "experiment", Name: "bioproject"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFieldsFlag() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseFieldsFlagTemplateFileBadRow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fields.tsv")
+	if err := os.WriteFile(path, []byte("no-tab-here\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := parseFieldsFlag(path); err == nil {
+		t.Error("parseFieldsFlag() on a malformed template = nil error, want an error")
+	}
+}
+
+func TestResolveField(t *testing.T) {
+	pkg := ExperimentPackage{
+		Experiment: Experiment{
+			Accession:  "SRX1",
+			BioProject: "PRJNA1",
+			Library:    LibraryDescriptor{Strategy: "AMPLICON"},
+		},
+		Sample: Sample{
+			Attributes:  []SampleAttribute{{Tag: "collection_date", Value: "2024-01-01"}},
+			Identifiers: []Identifier{{Namespace: "BioSample", Value: "SAMN1"}},
+		},
+		ReleaseDate: "2024-02-01",
+		LoadDate:    "2024-02-02",
+	}
+	run := Run{Accession: "SRR1", TotalBases: "1000"}
+
+	cases := []struct {
+		name string
+		src  fieldSource
+		want string
+	}{
+		{name: "sample_attr", src: fieldSource{Kind: "sample_attr", Name: "collection_date"}, want: "2024-01-01"},
+		{name: "identifier", src: fieldSource{Kind: "identifier", Name: "BioSample"}, want: "SAMN1"},
+		{name: "experiment bioproject", src: fieldSource{Kind: "experiment", Name: "bioproject"}, want: "PRJNA1"},
+		{name: "run_attr total_bases", src: fieldSource{Kind: "run_attr", Name: "total_bases"}, want: "1000"},
+		{name: "run_attr load_date falls back to package", src: fieldSource{Kind: "run_attr", Name: "load_date"}, want: "2024-02-02"},
+		{name: "run_attr released falls back to package", src: fieldSource{Kind: "run_attr", Name: "published"}, want: "2024-02-01"},
+		{name: "unknown kind", src: fieldSource{Kind: "bogus", Name: "x"}, want: ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := resolveField(pkg, run, tc.src); got != tc.want {
+				t.Errorf("resolveField() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -2,7 +2,10 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -11,6 +14,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,6 +22,7 @@ import (
 
 	// Import the DNA‐style progress bar package
 	"github.com/William-Gardner-Biotech/polybar/polybar"
+	"golang.org/x/time/rate"
 )
 
 const batchSize = 100
@@ -39,12 +44,6 @@ type IdList struct {
 	Ids []string `xml:"Id"`
 }
 
-// ExperimentPackageSet is the root element of the SRA metadata XML
-type ExperimentPackageSet struct {
-	XMLName  xml.Name            `xml:"EXPERIMENT_PACKAGE_SET"`
-	Packages []ExperimentPackage `xml:"EXPERIMENT_PACKAGE"`
-}
-
 // ExperimentPackage represents a single experiment with all its components
 type ExperimentPackage struct {
 	Experiment   Experiment    `xml:"EXPERIMENT"`
@@ -141,11 +140,41 @@ type Run struct {
 	ReleaseDate string `xml:"published,attr,omitempty"`
 }
 
-// Platform contains information about the sequencing platform
+// Platform contains information about the sequencing platform. NCBI's SRA
+// schema nests the instrument under a technology-specific child element
+// (ILLUMINA, OXFORD_NANOPORE, PACBIO_SMRT, ION_TORRENT, BGISEQ, CAPILLARY,
+// LS454, COMPLETE_GENOMICS, ...), so UnmarshalXML scans for whichever one
+// is actually present instead of hard-coding ILLUMINA.
 type Platform struct {
-	Illumina struct {
-		Instrument string `xml:"INSTRUMENT_MODEL"`
-	} `xml:"ILLUMINA"`
+	Technology string
+	Instrument string
+}
+
+// UnmarshalXML walks the children of <PLATFORM> and records the tag name of
+// the technology-specific child as Technology and its INSTRUMENT_MODEL as
+// Instrument.
+func (p *Platform) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			var instrument struct {
+				Model string `xml:"INSTRUMENT_MODEL"`
+			}
+			if err := d.DecodeElement(&instrument, &t); err != nil {
+				return err
+			}
+			p.Technology = t.Name.Local
+			p.Instrument = instrument.Model
+		case xml.EndElement:
+			if t.Name == start.Name {
+				return nil
+			}
+		}
+	}
 }
 
 // Organization contains information about the submitting organization
@@ -174,55 +203,227 @@ func extractIdentifier(ids []Identifier, ns string) string {
 	return ""
 }
 
-func fetchAllIDs(query string, api_key string) ([]string, error) {
+// searchHistory holds the NCBI history-server handle returned by an ESearch
+// call made with usehistory=y. EFetch can then page through the full result
+// set by referencing WebEnv/QueryKey instead of resending an ID list, which
+// avoids rebuilding multi-kilobyte URLs for large queries.
+type searchHistory struct {
+	WebEnv   string
+	QueryKey string
+	Count    int
+}
+
+// httpStatusError wraps a non-2xx Entrez response so callers can decide
+// whether it is worth retrying and how long to wait first.
+type httpStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d", e.StatusCode)
+}
+
+// retryableStatus reports whether an Entrez response with this status is
+// worth retrying. NCBI's own rate-limit response (429) and upstream 5xx
+// errors are transient; other 4xx codes mean the request itself is bad and
+// retrying would just waste the remaining attempts.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkStatus returns an *httpStatusError for any non-2xx response, carrying
+// the Retry-After duration if NCBI sent one.
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return &httpStatusError{StatusCode: resp.StatusCode, RetryAfter: retryAfter(resp)}
+}
+
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func fetchAllIDs(query string, api_key string, limiter *rate.Limiter) (searchHistory, error) {
 	params := url.Values{}
 	params.Set("db", "sra")
 	params.Set("term", query)
 	params.Set("retmode", "xml")
-	params.Set("retmax", "100000")
+	params.Set("usehistory", "y")
 	esearchURL := "https://eutils.ncbi.nlm.nih.gov/entrez/eutils/esearch.fcgi?" + params.Encode()
 	if api_key != "" {
 		esearchURL += "&api_key=" + api_key
 	}
+	if err := limiter.Wait(context.Background()); err != nil {
+		return searchHistory{}, err
+	}
 	resp, err := http.Get(esearchURL)
 	if err != nil {
-		return nil, err
+		return searchHistory{}, err
 	}
 	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return searchHistory{}, err
+	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return searchHistory{}, err
 	}
 	var result ESearchResult
 	if err := xml.Unmarshal(body, &result); err != nil {
-		return nil, err
+		return searchHistory{}, err
+	}
+	if result.WebEnv == "" || result.QueryKey == "" {
+		return searchHistory{}, fmt.Errorf("esearch response for query %q did not return a WebEnv/QueryKey", query)
 	}
-	return result.IdList.Ids, nil
+	return searchHistory{WebEnv: result.WebEnv, QueryKey: result.QueryKey, Count: result.Count}, nil
 }
 
-func fetchBatch(ids []string) (ExperimentPackageSet, error) {
-	var root ExperimentPackageSet
-	idParam := strings.Join(ids, ",")
-	url := fmt.Sprintf("https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?db=sra&id=%s&retmode=xml", idParam)
-	resp, err := http.Get(url)
+// fetchBatch pulls one page of EFetch results starting at retstart, using the
+// WebEnv/QueryKey handle from fetchAllIDs instead of an explicit ID list. It
+// walks the response token by token, decoding each ExperimentPackage as it
+// goes rather than buffering the whole EXPERIMENT_PACKAGE_SET in memory, so
+// memory use stays flat no matter how many records the overall query
+// returns. Decoded packages are held in a slice bounded by retmax (not
+// forwarded to out) until the whole page has decoded successfully: if the
+// stream drops partway through, the caller retries the same retstart, and
+// forwarding partial pages first would duplicate the already-sent records
+// once the retry re-decodes them.
+func fetchBatch(hist searchHistory, retstart, retmax int, api_key string, out chan<- ExperimentPackage, limiter *rate.Limiter) error {
+	params := url.Values{}
+	params.Set("db", "sra")
+	params.Set("retmode", "xml")
+	params.Set("WebEnv", hist.WebEnv)
+	params.Set("query_key", hist.QueryKey)
+	params.Set("retstart", strconv.Itoa(retstart))
+	params.Set("retmax", strconv.Itoa(retmax))
+	efetchURL := "https://eutils.ncbi.nlm.nih.gov/entrez/eutils/efetch.fcgi?" + params.Encode()
+	if api_key != "" {
+		efetchURL += "&api_key=" + api_key
+	}
+	if err := limiter.Wait(context.Background()); err != nil {
+		return err
+	}
+	resp, err := http.Get(efetchURL)
 	if err != nil {
-		return root, err
+		return err
 	}
 	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+
 	decoder := xml.NewDecoder(resp.Body)
-	err = decoder.Decode(&root)
-	return root, err
+
+	// The root element should be EXPERIMENT_PACKAGE_SET. NCBI returns a 200
+	// with an <eFetchResult><ERROR>...</ERROR></eFetchResult> body for things
+	// like an expired or invalid WebEnv/query_key, which the token loop below
+	// would otherwise silently read as zero packages and report success.
+	root, err := firstStartElement(decoder)
+	if err != nil {
+		return fmt.Errorf("reading efetch response for retstart=%d: %w", retstart, err)
+	}
+	if root.Name.Local != "EXPERIMENT_PACKAGE_SET" {
+		return fmt.Errorf("efetch response for retstart=%d had root element <%s>, not <EXPERIMENT_PACKAGE_SET>; the WebEnv/query_key may have expired or been rejected", retstart, root.Name.Local)
+	}
+
+	pkgs := make([]ExperimentPackage, 0, retmax)
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "EXPERIMENT_PACKAGE" {
+			continue
+		}
+		var pkg ExperimentPackage
+		if err := decoder.DecodeElement(&pkg, &start); err != nil {
+			return err
+		}
+		pkgs = append(pkgs, pkg)
+	}
+
+	for _, pkg := range pkgs {
+		out <- pkg
+	}
+	return nil
 }
 
-func chunkIDs(ids []string, size int) [][]string {
-	var chunks [][]string
-	for size < len(ids) {
-		ids, chunks = ids[size:], append(chunks, ids[0:size])
+// firstStartElement reads tokens off decoder until it finds the first
+// xml.StartElement (skipping the XML declaration and any leading
+// whitespace), so callers can validate a response's root element.
+func firstStartElement(decoder *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start, nil
+		}
 	}
-	return append(chunks, ids)
 }
 
-func writePackage(pkg ExperimentPackage, tsv *os.File) {
+// retstartOffsets returns the RetStart offset of every batch needed to page
+// through count records in chunks of size.
+func retstartOffsets(count, size int) []int {
+	var offsets []int
+	for offset := 0; offset < count; offset += size {
+		offsets = append(offsets, offset)
+	}
+	return offsets
+}
+
+// NCBI's published Entrez rate limits: 3 requests/second without an API
+// key, 10/second with one.
+const (
+	defaultRateLimit = 3
+	apiKeyRateLimit  = 10
+)
+
+// newRateLimiter returns a token bucket shared across every worker
+// goroutine, sized to NCBI's published limit for whether an API key is set.
+func newRateLimiter(apiKey string) *rate.Limiter {
+	limit := defaultRateLimit
+	if apiKey != "" {
+		limit = apiKeyRateLimit
+	}
+	return rate.NewLimiter(rate.Limit(limit), limit)
+}
+
+// packageFields holds the BioProject/BioSample-level values shared by both
+// the flat TSV writer and the hierarchical JSON aggregator, so the two
+// output paths can't drift on how a field is derived.
+type packageFields struct {
+	BioProject     string
+	BioSample      string
+	Submitter      string
+	CollectionDate string
+	Location       string
+	Population     string
+}
+
+func extractPackageFields(pkg ExperimentPackage) packageFields {
 	exp := pkg.Experiment
 	sample := pkg.Sample
 
@@ -235,10 +436,6 @@ func writePackage(pkg ExperimentPackage, tsv *os.File) {
 		}
 	}
 
-	collDate := extractSampleValue(sample.Attributes, "collection_date")
-	geoLoc := extractSampleValue(sample.Attributes, "geo_loc_name")
-	pop := extractSampleValue(sample.Attributes, "ww_population")
-
 	submitter := pkg.Organization.Name
 	if submitter == "" {
 		submitter = extractSampleValue(sample.Attributes, "submitter")
@@ -250,6 +447,19 @@ func writePackage(pkg ExperimentPackage, tsv *os.File) {
 		}
 	}
 
+	return packageFields{
+		BioProject:     bioproject,
+		BioSample:      biosample,
+		Submitter:      submitter,
+		CollectionDate: extractSampleValue(sample.Attributes, "collection_date"),
+		Location:       extractSampleValue(sample.Attributes, "geo_loc_name"),
+		Population:     extractSampleValue(sample.Attributes, "ww_population"),
+	}
+}
+
+func writePackage(pkg ExperimentPackage, tsv *os.File) {
+	f := extractPackageFields(pkg)
+
 	for _, run := range pkg.RunSet.Runs {
 		releaseDate := run.ReleaseDate
 		loadDate := run.LoadDate
@@ -259,20 +469,315 @@ func writePackage(pkg ExperimentPackage, tsv *os.File) {
 		if loadDate == "" {
 			loadDate = pkg.LoadDate
 		}
-		tsv.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+		tsv.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
 			run.Accession,
-			bioproject,
-			biosample,
-			submitter,
-			collDate,
-			geoLoc,
-			pop,
+			f.BioProject,
+			f.BioSample,
+			f.Submitter,
+			f.CollectionDate,
+			f.Location,
+			f.Population,
 			run.TotalSpots,
 			releaseDate,
-			loadDate))
+			loadDate,
+			pkg.Platform.Technology,
+			pkg.Platform.Instrument))
+	}
+}
+
+// fieldSource identifies where a -fields template column's value is pulled
+// from: a SAMPLE_ATTRIBUTE tag, a namespaced IDENTIFIERS entry, a run-level
+// field, or an experiment-level field.
+type fieldSource struct {
+	Kind string
+	Name string
+}
+
+// field is one output column driven by a -fields template: its header name
+// and where to read its value from.
+type field struct {
+	Column string
+	Source fieldSource
+}
+
+// validRunAttrFields and validExperimentFields enumerate the field names
+// resolveField understands for the "run_attr" and "experiment" source
+// kinds, so a typo in a template fails at parse time instead of silently
+// producing an empty column. "sample_attr" and "identifier" names are
+// per-submission NCBI tags and namespaces, so those aren't validated here.
+var (
+	validRunAttrFields    = map[string]bool{"accession": true, "total_spots": true, "total_bases": true, "load_date": true, "published": true, "release_date": true}
+	validExperimentFields = map[string]bool{"accession": true, "title": true, "library_strategy": true, "library_source": true, "library_selection": true, "bioproject": true}
+)
+
+func parseFieldSource(spec string) (fieldSource, error) {
+	kind, name, ok := strings.Cut(spec, ":")
+	if !ok {
+		return fieldSource{}, fmt.Errorf("field source %q must be kind:name, e.g. sample_attr:collection_date", spec)
+	}
+	switch kind {
+	case "sample_attr", "identifier":
+		return fieldSource{Kind: kind, Name: name}, nil
+	case "run_attr":
+		if !validRunAttrFields[name] {
+			return fieldSource{}, fmt.Errorf("unknown run_attr field %q in %q", name, spec)
+		}
+		return fieldSource{Kind: kind, Name: name}, nil
+	case "experiment":
+		if !validExperimentFields[name] {
+			return fieldSource{}, fmt.Errorf("unknown experiment field %q in %q", name, spec)
+		}
+		return fieldSource{Kind: kind, Name: name}, nil
+	default:
+		return fieldSource{}, fmt.Errorf("unknown field source kind %q in %q (want sample_attr, identifier, run_attr, or experiment)", kind, spec)
 	}
 }
 
+// parseFieldsFlag turns a -fields value into a column template. The value is
+// either a path to a TSV template file (one "column<TAB>kind:name" row per
+// line, blank lines and #-comments ignored) or a plain comma-separated list
+// of SAMPLE_ATTRIBUTE tag names, shorthand for a sample_attr column per tag.
+func parseFieldsFlag(value string) ([]field, error) {
+	if info, err := os.Stat(value); err == nil && !info.IsDir() {
+		return parseFieldTemplateFile(value)
+	}
+
+	var fields []field
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		fields = append(fields, field{Column: tag, Source: fieldSource{Kind: "sample_attr", Name: tag}})
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("-fields %q did not resolve to any columns", value)
+	}
+	return fields, nil
+}
+
+func parseFieldTemplateFile(path string) ([]field, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []field
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		column, source, ok := strings.Cut(line, "\t")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected \"column<TAB>source\", got %q", path, i+1, line)
+		}
+		src, err := parseFieldSource(strings.TrimSpace(source))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		fields = append(fields, field{Column: strings.TrimSpace(column), Source: src})
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("template %s defined no columns", path)
+	}
+	return fields, nil
+}
+
+// resolveField reads one template column's value for a given run out of its
+// parent package.
+func resolveField(pkg ExperimentPackage, run Run, src fieldSource) string {
+	switch src.Kind {
+	case "sample_attr":
+		return extractSampleValue(pkg.Sample.Attributes, src.Name)
+	case "identifier":
+		return extractIdentifier(pkg.Sample.Identifiers, src.Name)
+	case "experiment":
+		switch src.Name {
+		case "accession":
+			return pkg.Experiment.Accession
+		case "title":
+			return pkg.Experiment.Title
+		case "library_strategy":
+			return pkg.Experiment.Library.Strategy
+		case "library_source":
+			return pkg.Experiment.Library.Source
+		case "library_selection":
+			return pkg.Experiment.Library.Selection
+		case "bioproject":
+			return pkg.Experiment.BioProject
+		default:
+			return ""
+		}
+	case "run_attr":
+		switch src.Name {
+		case "accession":
+			return run.Accession
+		case "total_spots":
+			return run.TotalSpots
+		case "total_bases":
+			return run.TotalBases
+		case "load_date":
+			if run.LoadDate != "" {
+				return run.LoadDate
+			}
+			return pkg.LoadDate
+		case "published", "release_date":
+			if run.ReleaseDate != "" {
+				return run.ReleaseDate
+			}
+			return pkg.ReleaseDate
+		default:
+			return ""
+		}
+	default:
+		return ""
+	}
+}
+
+// writePackageFields writes one TSV row per run using a -fields template
+// instead of the fixed default columns.
+func writePackageFields(pkg ExperimentPackage, tsv *os.File, fields []field) {
+	for _, run := range pkg.RunSet.Runs {
+		values := make([]string, len(fields)+1)
+		values[0] = run.Accession
+		for i, f := range fields {
+			values[i+1] = resolveField(pkg, run, f.Source)
+		}
+		tsv.WriteString(strings.Join(values, "\t") + "\n")
+	}
+}
+
+// RunSummary is the leaf of the hierarchical JSON output.
+type RunSummary struct {
+	Accession   string `json:"accession"`
+	TotalSpots  string `json:"totalSpots,omitempty"`
+	ReleaseDate string `json:"releaseDate,omitempty"`
+	LoadDate    string `json:"loadDate,omitempty"`
+}
+
+// ExperimentSummary groups the runs produced by one SRA experiment.
+type ExperimentSummary struct {
+	Accession string       `json:"accession"`
+	Strategy  string       `json:"libraryStrategy,omitempty"`
+	Runs      []RunSummary `json:"runs"`
+}
+
+// BioSampleSummary groups the experiments submitted under one BioSample.
+type BioSampleSummary struct {
+	Accession      string              `json:"accession"`
+	Submitter      string              `json:"submitter,omitempty"`
+	CollectionDate string              `json:"collectionDate,omitempty"`
+	Location       string              `json:"location,omitempty"`
+	Population     string              `json:"population,omitempty"`
+	Experiments    []ExperimentSummary `json:"experiments"`
+	TotalRuns      int                 `json:"totalRuns"`
+}
+
+// BioProject is the top level of the hierarchical JSON output: a BioProject
+// containing its BioSamples, each containing its Experiments, each
+// containing its Runs.
+type BioProject struct {
+	Accession  string             `json:"accession"`
+	BioSamples []BioSampleSummary `json:"bioSamples"`
+	TotalRuns  int                `json:"totalRuns"`
+}
+
+// aggregateByBioProject drains pkgs and groups them into the
+// BioProject -> BioSample -> Experiment -> Runs hierarchy.
+func aggregateByBioProject(pkgs <-chan ExperimentPackage) []BioProject {
+	projectIndex := make(map[string]int)
+	sampleIndex := make(map[string]map[string]int)
+	var projects []BioProject
+
+	for pkg := range pkgs {
+		f := extractPackageFields(pkg)
+
+		pi, ok := projectIndex[f.BioProject]
+		if !ok {
+			pi = len(projects)
+			projects = append(projects, BioProject{Accession: f.BioProject})
+			projectIndex[f.BioProject] = pi
+			sampleIndex[f.BioProject] = make(map[string]int)
+		}
+
+		si, ok := sampleIndex[f.BioProject][f.BioSample]
+		if !ok {
+			si = len(projects[pi].BioSamples)
+			projects[pi].BioSamples = append(projects[pi].BioSamples, BioSampleSummary{
+				Accession:      f.BioSample,
+				Submitter:      f.Submitter,
+				CollectionDate: f.CollectionDate,
+				Location:       f.Location,
+				Population:     f.Population,
+			})
+			sampleIndex[f.BioProject][f.BioSample] = si
+		}
+
+		runs := make([]RunSummary, 0, len(pkg.RunSet.Runs))
+		for _, run := range pkg.RunSet.Runs {
+			releaseDate := run.ReleaseDate
+			loadDate := run.LoadDate
+			if releaseDate == "" {
+				releaseDate = pkg.ReleaseDate
+			}
+			if loadDate == "" {
+				loadDate = pkg.LoadDate
+			}
+			runs = append(runs, RunSummary{
+				Accession:   run.Accession,
+				TotalSpots:  run.TotalSpots,
+				ReleaseDate: releaseDate,
+				LoadDate:    loadDate,
+			})
+		}
+
+		sample := &projects[pi].BioSamples[si]
+		sample.Experiments = append(sample.Experiments, ExperimentSummary{
+			Accession: pkg.Experiment.Accession,
+			Strategy:  pkg.Experiment.Library.Strategy,
+			Runs:      runs,
+		})
+		sample.TotalRuns += len(runs)
+		projects[pi].TotalRuns += len(runs)
+	}
+
+	return projects
+}
+
+// checkpoint is a resumable snapshot of an in-progress fetch, persisted as a
+// small sidecar JSON file next to the output. Saving it after every
+// successful batch lets an interrupted run pick up with -resume instead of
+// restarting the whole query from scratch.
+type checkpoint struct {
+	Query             string `json:"query"`
+	WebEnv            string `json:"webEnv"`
+	QueryKey          string `json:"queryKey"`
+	TotalCount        int    `json:"totalCount"`
+	CompletedRetStart []int  `json:"completedRetStart"`
+	OutputPath        string `json:"outputPath"`
+}
+
+func loadCheckpoint(path string) (checkpoint, error) {
+	var cp checkpoint
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cp, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, err
+	}
+	return cp, nil
+}
+
+func (cp checkpoint) save(path string) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
 func main() {
 	// Maximum number of retries for each goroutine
 	const maxRetries = 7
@@ -281,25 +786,87 @@ func main() {
 	api_key := flag.String("api-key", "", "NCBI API key to increase requests, it increases speed but is not required.")
 	startDate := flag.String("start", "2024/09/15", "Start date (yyyy/mm/dd)")
 	endDate := flag.String("end", "2030/12/31", "End date (yyyy/mm/dd)")
+	format := flag.String("format", "tsv", "Output format: tsv (flat, one row per run) or json (hierarchical BioProject>BioSample>Experiment>Runs)")
+	resumePath := flag.String("resume", "", "Resume an interrupted run from a checkpoint JSON file written by a previous run")
+	fieldsFlag := flag.String("fields", "", "Comma-separated SAMPLE_ATTRIBUTE tag names, or a path to a TSV template mapping output column to source (sample_attr:TAG, identifier:NS, run_attr:FIELD, experiment:FIELD). Replaces the default TSV columns after RunAccession, which is always the first column; only valid with -format tsv.")
 	flag.Parse()
 
+	if *format != "tsv" && *format != "json" {
+		log.Fatalf("Unsupported -format %q: must be \"tsv\" or \"json\"", *format)
+	}
+	if *resumePath != "" && *format != "tsv" {
+		log.Fatalf("-resume only supports -format tsv: JSON output is a single aggregated document and can't be resumed by appending")
+	}
+	if *fieldsFlag != "" && *format != "tsv" {
+		log.Fatalf("-fields only applies to -format tsv")
+	}
+	if *fieldsFlag != "" && *resumePath != "" {
+		log.Fatalf("-fields can't be combined with -resume: the checkpoint doesn't record which template the original run used, so a resumed run could append rows under a mismatched header")
+	}
+
+	var fields []field
+	if *fieldsFlag != "" {
+		parsed, err := parseFieldsFlag(*fieldsFlag)
+		if err != nil {
+			log.Fatalf("Invalid -fields: %v", err)
+		}
+		fields = parsed
+	}
+
 	// Time the function
 	start := time.Now()
 	defer func() {
 		log.Printf("Total time of main function: %.2fs", time.Since(start).Seconds())
 	}()
 
-	ts := time.Now().Format("06.01.02.15.04")
-	tsvFile := fmt.Sprintf("parsed_metadata.%s.tsv", ts)
+	limiter := newRateLimiter(*api_key)
 
-	query := fmt.Sprintf("(%s) AND (\"%s\"[PDAT] : \"%s\"[PDAT])", *term, *startDate, *endDate)
-	ids, err := fetchAllIDs(query, *api_key)
-	if err != nil {
-		log.Fatalf("Failed to retrieve IDs: %v", err)
+	var cp checkpoint
+	var outFile string
+	var checkpointPath string
+	completedBatches := make(map[int]bool)
+
+	if *resumePath != "" {
+		loaded, err := loadCheckpoint(*resumePath)
+		if err != nil {
+			log.Fatalf("Failed to load checkpoint %s: %v", *resumePath, err)
+		}
+		cp = loaded
+		outFile = cp.OutputPath
+		checkpointPath = *resumePath
+		for _, retstart := range cp.CompletedRetStart {
+			completedBatches[retstart] = true
+		}
+
+		currentQuery := fmt.Sprintf("(%s) AND (\"%s\"[PDAT] : \"%s\"[PDAT])", *term, *startDate, *endDate)
+		if currentQuery != cp.Query {
+			fmt.Fprintf(os.Stderr, "Warning: -term/-start/-end (query %q) don't match the checkpoint's original query %q; resumed rows will still be appended under the checkpoint's WebEnv/QueryKey\n", currentQuery, cp.Query)
+		}
+
+		fmt.Fprintf(os.Stderr, "Resuming %s: %d/%d batches already completed\n", outFile, len(completedBatches), (cp.TotalCount+batchSize-1)/batchSize)
+	} else {
+		ts := time.Now().Format("06.01.02.15.04")
+		outFile = fmt.Sprintf("parsed_metadata.%s.%s", ts, *format)
+		checkpointPath = outFile + ".checkpoint.json"
+
+		query := fmt.Sprintf("(%s) AND (\"%s\"[PDAT] : \"%s\"[PDAT])", *term, *startDate, *endDate)
+		hist, err := fetchAllIDs(query, *api_key, limiter)
+		if err != nil {
+			log.Fatalf("Failed to retrieve IDs: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Found %d IDs\n", hist.Count)
+
+		cp = checkpoint{Query: query, WebEnv: hist.WebEnv, QueryKey: hist.QueryKey, TotalCount: hist.Count, OutputPath: outFile}
 	}
-	fmt.Fprintf(os.Stderr, "Found %d IDs\n", len(ids))
 
-	batches := chunkIDs(ids, batchSize)
+	hist := searchHistory{WebEnv: cp.WebEnv, QueryKey: cp.QueryKey, Count: cp.TotalCount}
+
+	var batches []int
+	for _, retstart := range retstartOffsets(cp.TotalCount, batchSize) {
+		if !completedBatches[retstart] {
+			batches = append(batches, retstart)
+		}
+	}
 	total := int32(len(batches))
 
 	// Create the DNA-style progress bar. Header “Fetching Batches” can be replaced with "" if you want no header.
@@ -307,7 +874,57 @@ func main() {
 	pb.Start(int(total))
 
 	var completed int32
-	results := make(chan ExperimentPackageSet, len(batches))
+	results := make(chan ExperimentPackage, maxWorkers*batchSize)
+
+	var out *os.File
+	var err error
+	if *resumePath != "" {
+		out, err = os.OpenFile(outFile, os.O_WRONLY|os.O_APPEND, 0644)
+	} else {
+		out, err = os.Create(outFile)
+	}
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", outFile, err)
+	}
+	defer out.Close()
+
+	// Drain results as they arrive so the channel never has to hold the
+	// whole result set at once. The TSV path writes one row per run as
+	// packages stream in; the JSON path has to aggregate the full hierarchy
+	// before it can be encoded, so it drains the channel itself.
+	var writeWG sync.WaitGroup
+	writeWG.Add(1)
+	go func() {
+		defer writeWG.Done()
+		switch *format {
+		case "json":
+			projects := aggregateByBioProject(results)
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(projects); err != nil {
+				log.Fatalf("Failed to write JSON: %v", err)
+			}
+		default:
+			if *resumePath == "" {
+				if len(fields) > 0 {
+					header := make([]string, len(fields))
+					for i, f := range fields {
+						header[i] = f.Column
+					}
+					out.WriteString("RunAccession\t" + strings.Join(header, "\t") + "\n")
+				} else {
+					out.WriteString("RunAccession\tBioProject\tBioSample\tSubmitter\tCollectionDate\tLocation\tPopulation\tTotalSpots\tReleaseDate\tLoadDate\tTechnology\tInstrument\n")
+				}
+			}
+			for pkg := range results {
+				if len(fields) > 0 {
+					writePackageFields(pkg, out, fields)
+				} else {
+					writePackage(pkg, out)
+				}
+			}
+		}
+	}()
 
 	// Launch a single goroutine to monitor `completed` and update the bar.
 	go func() {
@@ -330,36 +947,57 @@ func main() {
 
 
 	var wg sync.WaitGroup
+	var cpMu sync.Mutex
 	sem := make(chan struct{}, maxWorkers)
 
-	for _, batch := range batches {
+	for _, retstart := range batches {
 		wg.Add(1)
 		sem <- struct{}{}
 
-		go func(idList []string) {
+		go func(retstart int) {
 			defer wg.Done()
 			defer func() { <-sem }()
 
-			var pkgSet ExperimentPackageSet
 			var err error
 
 			for attempt := 0; attempt < maxRetries; attempt++ {
-				if attempt > 0 {
-					sleepDuration := time.Duration(math.Pow(2, float64(attempt))) * time.Second
-					time.Sleep(sleepDuration)
-					if attempt > 5 {
-						fmt.Fprintf(os.Stderr, "Retrying batch after %v...\n", sleepDuration)
-					}
-				}
-				pkgSet, err = fetchBatch(idList)
+				err = fetchBatch(hist, retstart, batchSize, *api_key, results, limiter)
 				if err == nil {
-					results <- pkgSet
 					atomic.AddInt32(&completed, 1)
+
+					cpMu.Lock()
+					cp.CompletedRetStart = append(cp.CompletedRetStart, retstart)
+					if err := cp.save(checkpointPath); err != nil {
+						fmt.Fprintf(os.Stderr, "Failed to write checkpoint %s: %v\n", checkpointPath, err)
+					}
+					cpMu.Unlock()
 					return
 				}
+
+				var statusErr *httpStatusError
+				if errors.As(err, &statusErr) {
+					if !retryableStatus(statusErr.StatusCode) {
+						fmt.Fprintf(os.Stderr, "Batch at retstart=%d failed with non-retryable HTTP %d, giving up\n", retstart, statusErr.StatusCode)
+						return
+					}
+					fmt.Fprintf(os.Stderr, "Batch at retstart=%d got HTTP %d, retrying...\n", retstart, statusErr.StatusCode)
+				}
+
+				if attempt == maxRetries-1 {
+					break
+				}
+
+				sleepDuration := time.Duration(math.Pow(2, float64(attempt+1))) * time.Second
+				if statusErr != nil && statusErr.RetryAfter > 0 {
+					sleepDuration = statusErr.RetryAfter
+				}
+				if attempt > 5 {
+					fmt.Fprintf(os.Stderr, "Retrying batch at retstart=%d after %v...\n", retstart, sleepDuration)
+				}
+				time.Sleep(sleepDuration)
 			}
-			fmt.Fprintf(os.Stderr, "Failed batch after retries: %v\n", err)
-		}(batch)
+			fmt.Fprintf(os.Stderr, "Failed batch at retstart=%d after retries: %v\n", retstart, err)
+		}(retstart)
 	}
 
 	wg.Wait()
@@ -367,18 +1005,7 @@ func main() {
 	pb.Finish()
 
 	close(results)
+	writeWG.Wait()
 
-	tsv, err := os.Create(tsvFile)
-	if err != nil {
-		log.Fatalf("Failed to create TSV: %v", err)
-	}
-	defer tsv.Close()
-	tsv.WriteString("RunAccession\tBioProject\tBioSample\tSubmitter\tCollectionDate\tLocation\tPopulation\tTotalSpots\tReleaseDate\tLoadDate\n")
-
-	for pkgSet := range results {
-		for _, pkg := range pkgSet.Packages {
-			writePackage(pkg, tsv)
-		}
-	}
-	fmt.Fprintf(os.Stderr, "Saved parsed metadata to %s\n", tsvFile)
+	fmt.Fprintf(os.Stderr, "Saved parsed metadata to %s\n", outFile)
 }
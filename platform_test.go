@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestPlatformUnmarshalXML(t *testing.T) {
+	cases := []struct {
+		name           string
+		xmlData        string
+		wantTechnology string
+		wantInstrument string
+	}{
+		{
+			name:           "illumina",
+			xmlData:        `<PLATFORM><ILLUMINA><INSTRUMENT_MODEL>NovaSeq 6000</INSTRUMENT_MODEL></ILLUMINA></PLATFORM>`,
+			wantTechnology: "ILLUMINA",
+			wantInstrument: "NovaSeq 6000",
+		},
+		{
+			name:           "oxford nanopore",
+			xmlData:        `<PLATFORM><OXFORD_NANOPORE><INSTRUMENT_MODEL>MinION</INSTRUMENT_MODEL></OXFORD_NANOPORE></PLATFORM>`,
+			wantTechnology: "OXFORD_NANOPORE",
+			wantInstrument: "MinION",
+		},
+		{
+			name:           "pacbio",
+			xmlData:        `<PLATFORM><PACBIO_SMRT><INSTRUMENT_MODEL>Sequel II</INSTRUMENT_MODEL></PACBIO_SMRT></PLATFORM>`,
+			wantTechnology: "PACBIO_SMRT",
+			wantInstrument: "Sequel II",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var p Platform
+			if err := xml.Unmarshal([]byte(tc.xmlData), &p); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if p.Technology != tc.wantTechnology {
+				t.Errorf("Technology = %q, want %q", p.Technology, tc.wantTechnology)
+			}
+			if p.Instrument != tc.wantInstrument {
+				t.Errorf("Instrument = %q, want %q", p.Instrument, tc.wantInstrument)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryableStatus(t *testing.T) {
+	cases := []struct {
+		code      int
+		retryable bool
+	}{
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusGatewayTimeout, true},
+		{http.StatusBadRequest, false},
+		{http.StatusNotFound, false},
+		{http.StatusOK, false},
+	}
+
+	for _, tc := range cases {
+		if got := retryableStatus(tc.code); got != tc.retryable {
+			t.Errorf("retryableStatus(%d) = %v, want %v", tc.code, got, tc.retryable)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{name: "absent", header: "", want: 0},
+		{name: "seconds", header: "30", want: 30 * time.Second},
+		{name: "not a number or date", header: "garbage", want: 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tc.header != "" {
+				resp.Header.Set("Retry-After", tc.header)
+			}
+			if got := retryAfter(resp); got != tc.want {
+				t.Errorf("retryAfter() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	okResp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	if err := checkStatus(okResp); err != nil {
+		t.Errorf("checkStatus(200) = %v, want nil", err)
+	}
+
+	rateLimited := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"5"}}}
+	err := checkStatus(rateLimited)
+	if err == nil {
+		t.Fatal("checkStatus(429) = nil, want an error")
+	}
+	statusErr, ok := err.(*httpStatusError)
+	if !ok {
+		t.Fatalf("checkStatus(429) returned %T, want *httpStatusError", err)
+	}
+	if statusErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("StatusCode = %d, want %d", statusErr.StatusCode, http.StatusTooManyRequests)
+	}
+	if statusErr.RetryAfter != 5*time.Second {
+		t.Errorf("RetryAfter = %v, want %v", statusErr.RetryAfter, 5*time.Second)
+	}
+}